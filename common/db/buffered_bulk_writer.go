@@ -0,0 +1,269 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxMessageSizeBytes is the approximate cap on the size of a single bulk write
+// message that the server will accept. BufferedBulkWriter flushes before an
+// in-flight batch could grow past this, regardless of docLimit.
+const maxMessageSizeBytes = 48 * 1000 * 1000
+
+// noWatermark marks a buffered model as not corresponding to any position in an input stream, so it's ignored when
+// Flush computes the watermark to report to a PostFlushHook.
+const noWatermark int64 = -1
+
+// PostFlushHook is invoked after a Flush whose bulk write succeeded, in whole or in part, with the watermark of the
+// furthest point in the input stream that is now durably written. See BufferedBulkWriter.SetPostFlushHook.
+type PostFlushHook func(watermark int64) error
+
+// BufferedBulkWriter implements a bufio.Writer-like design for queuing up
+// write models of mixed type (insert, update, replace, delete) and executing
+// them in bulk via collection.BulkWrite once the given doc limit or
+// accumulated byte-size limit is reached. Must be flushed at the end to
+// ensure that all buffered models are written.
+type BufferedBulkWriter struct {
+	collection    *mongo.Collection
+	models        []mongo.WriteModel
+	watermarks    []int64
+	docLimit      int
+	docCount      int
+	byteCount     int
+	bulkWriteOpts *options.BulkWriteOptions
+	postFlushHook PostFlushHook
+}
+
+func newBufferedBulkWriter(collection *mongo.Collection, docLimit int, ordered bool) *BufferedBulkWriter {
+	bb := &BufferedBulkWriter{
+		collection:    collection,
+		bulkWriteOpts: options.BulkWrite().SetOrdered(ordered),
+		docLimit:      docLimit,
+		models:        make([]mongo.WriteModel, 0, docLimit),
+		watermarks:    make([]int64, 0, docLimit),
+	}
+	return bb
+}
+
+// NewOrderedBufferedBulkWriter returns an initialized BufferedBulkWriter for performing ordered bulk writes.
+func NewOrderedBufferedBulkWriter(collection *mongo.Collection, docLimit int) *BufferedBulkWriter {
+	return newBufferedBulkWriter(collection, docLimit, true)
+}
+
+// NewUnorderedBufferedBulkWriter returns an initialized BufferedBulkWriter for performing unordered bulk writes.
+func NewUnorderedBufferedBulkWriter(collection *mongo.Collection, docLimit int) *BufferedBulkWriter {
+	return newBufferedBulkWriter(collection, docLimit, false)
+}
+
+func (bb *BufferedBulkWriter) SetOrdered(ordered bool) *BufferedBulkWriter {
+	bb.bulkWriteOpts.SetOrdered(ordered)
+	return bb
+}
+
+func (bb *BufferedBulkWriter) SetBypassDocumentValidation(bypass bool) *BufferedBulkWriter {
+	bb.bulkWriteOpts.SetBypassDocumentValidation(bypass)
+	return bb
+}
+
+// SetPostFlushHook registers a hook that Flush invokes after a bulk write that succeeded in whole or in part, passing
+// the watermark of the furthest point in the input stream that is now durably written (the highest watermark of the
+// documents that were added via InsertRawWithWatermark and are known to have been written). Used by mongorestore to journal restore
+// progress so an interrupted restore can resume rather than starting over.
+func (bb *BufferedBulkWriter) SetPostFlushHook(hook PostFlushHook) *BufferedBulkWriter {
+	bb.postFlushHook = hook
+	return bb
+}
+
+// throw away the old batch and init a new one
+func (bb *BufferedBulkWriter) resetBulk() {
+	bb.models = bb.models[:0]
+	bb.watermarks = bb.watermarks[:0]
+	bb.docCount = 0
+	bb.byteCount = 0
+}
+
+// Insert adds a document to the buffer for bulk insertion. If the buffer becomes full, the bulk write is performed, returning
+// any error that occurs.
+func (bb *BufferedBulkWriter) Insert(doc interface{}) (*mongo.BulkWriteResult, error) {
+	rawBytes, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("bson encoding error: %v", err)
+	}
+
+	return bb.InsertRaw(rawBytes)
+}
+
+// InsertRaw adds a document, represented as raw bson bytes, to the buffer for bulk insertion. If the buffer becomes full,
+// the bulk write is performed, returning any error that occurs.
+func (bb *BufferedBulkWriter) InsertRaw(rawBytes bson.Raw) (*mongo.BulkWriteResult, error) {
+	return bb.addModel(mongo.NewInsertOneModel().SetDocument(rawBytes), len(rawBytes), noWatermark)
+}
+
+// InsertRawWithWatermark is InsertRaw, additionally recording watermark as the position of this document (e.g. its
+// byte offset in the source file) for the registered PostFlushHook to report once the document is durably written.
+func (bb *BufferedBulkWriter) InsertRawWithWatermark(rawBytes bson.Raw, watermark int64) (*mongo.BulkWriteResult, error) {
+	return bb.addModel(mongo.NewInsertOneModel().SetDocument(rawBytes), len(rawBytes), watermark)
+}
+
+// Update adds an update-one (or update-many, if multi is set) write model to the buffer. If the buffer becomes full,
+// the bulk write is performed, returning any error that occurs.
+func (bb *BufferedBulkWriter) Update(filter, update interface{}, upsert, multi bool) (*mongo.BulkWriteResult, error) {
+	size, err := modelSize(filter, update)
+	if err != nil {
+		return nil, err
+	}
+
+	if multi {
+		model := mongo.NewUpdateManyModel().SetFilter(filter).SetUpdate(update).SetUpsert(upsert)
+		return bb.addModel(model, size, noWatermark)
+	}
+
+	model := mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(upsert)
+	return bb.addModel(model, size, noWatermark)
+}
+
+// Replace adds a replace-one write model to the buffer. If the buffer becomes full, the bulk write is performed,
+// returning any error that occurs.
+func (bb *BufferedBulkWriter) Replace(filter, replacement interface{}, upsert bool) (*mongo.BulkWriteResult, error) {
+	size, err := modelSize(filter, replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	model := mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(replacement).SetUpsert(upsert)
+	return bb.addModel(model, size, noWatermark)
+}
+
+// Delete adds a delete-one (or delete-many, if multi is set) write model to the buffer. If the buffer becomes full,
+// the bulk write is performed, returning any error that occurs.
+func (bb *BufferedBulkWriter) Delete(filter interface{}, multi bool) (*mongo.BulkWriteResult, error) {
+	size, err := modelSize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if multi {
+		return bb.addModel(mongo.NewDeleteManyModel().SetFilter(filter), size, noWatermark)
+	}
+
+	return bb.addModel(mongo.NewDeleteOneModel().SetFilter(filter), size, noWatermark)
+}
+
+// addModel adds a WriteModel of approximately size bytes to the buffer, recording watermark (or noWatermark) as its
+// position in the input stream. If queuing it would push the batch past maxMessageSizeBytes, the current batch is
+// flushed first. If, after adding it, docLimit documents are now queued or the batch has reached
+// maxMessageSizeBytes, the bulk write is performed, returning any error that occurs.
+func (bb *BufferedBulkWriter) addModel(model mongo.WriteModel, size int, watermark int64) (*mongo.BulkWriteResult, error) {
+	if bb.docCount > 0 && bb.byteCount+size > maxMessageSizeBytes {
+		if _, err := bb.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	bb.docCount++
+	bb.byteCount += size
+	bb.models = append(bb.models, model)
+	bb.watermarks = append(bb.watermarks, watermark)
+
+	if bb.docCount >= bb.docLimit || bb.byteCount >= maxMessageSizeBytes {
+		return bb.Flush()
+	}
+
+	return nil, nil
+}
+
+// Flush writes all buffered write models in one bulk write, then — if a PostFlushHook is registered and the write
+// produced a safe watermark to report — invokes it with that watermark, and finally resets the buffer. On a clean bulk
+// write this is the highest watermark in the batch. On a partial BulkWriteException, it's the highest watermark
+// among the models strictly before the first failed one; nothing is reported if the first model failed. Any other
+// error (network, timeout, auth, a whole-command failure) leaves every model's outcome unknown, so no watermark is
+// reported at all.
+func (bb *BufferedBulkWriter) Flush() (*mongo.BulkWriteResult, error) {
+	if bb.docCount == 0 {
+		return nil, nil
+	}
+
+	models, watermarks := bb.models, bb.watermarks
+	defer bb.resetBulk()
+
+	result, err := bb.collection.BulkWrite(context.Background(), models, bb.bulkWriteOpts)
+
+	if bb.postFlushHook != nil {
+		if watermark, ok := flushWatermark(watermarks, err); ok {
+			if hookErr := bb.postFlushHook(watermark); hookErr != nil && err == nil {
+				err = hookErr
+			}
+		}
+	}
+
+	return result, err
+}
+
+// flushWatermark computes the watermark to report to a PostFlushHook for a batch whose per-model watermarks are
+// watermarks and whose bulk write returned err. The second return value is false if there is no watermark that's
+// safe to consider durable.
+//
+// err == nil means the whole batch succeeded, so the highest watermark in it is safe. A mongo.BulkWriteException
+// means only some models succeeded; since watermarks are monotonic in input order, the only index we can be sure
+// is durable without gaps is one strictly before the first failed index, so we take the highest watermark below
+// that point (none, if the very first model failed). Any other error (network, timeout, auth, a whole-command
+// failure) leaves every model's fate unknown, so nothing is reported.
+func flushWatermark(watermarks []int64, err error) (int64, bool) {
+	var limit int
+	if err == nil {
+		limit = len(watermarks)
+	} else {
+		bwErr, partial := err.(mongo.BulkWriteException)
+		if !partial {
+			return 0, false
+		}
+
+		minFailedIndex := -1
+		for _, writeErr := range bwErr.WriteErrors {
+			if minFailedIndex == -1 || writeErr.Index < minFailedIndex {
+				minFailedIndex = writeErr.Index
+			}
+		}
+		if minFailedIndex <= 0 {
+			return 0, false
+		}
+		limit = minFailedIndex
+	}
+
+	found := false
+	var result int64
+	for _, wm := range watermarks[:limit] {
+		if wm == noWatermark {
+			continue
+		}
+		if !found || wm > result {
+			result, found = wm, true
+		}
+	}
+
+	return result, found
+}
+
+// modelSize returns the approximate on-wire size, in bytes, of a write model built from the given BSON-marshalable
+// parts. It's used to decide when an in-progress batch needs to be flushed to stay under maxMessageSizeBytes.
+func modelSize(parts ...interface{}) (int, error) {
+	size := 0
+	for _, part := range parts {
+		raw, err := bson.Marshal(part)
+		if err != nil {
+			return 0, fmt.Errorf("bson encoding error: %v", err)
+		}
+		size += len(raw)
+	}
+	return size, nil
+}
@@ -0,0 +1,255 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// clientModel is one buffered document, along with the namespace it targets, so a ClientBulkWriter can batch
+// documents across many collections into a single client-level bulk write and still route and report on each one
+// individually.
+type clientModel struct {
+	namespace  string
+	database   string
+	collection string
+	doc        bson.Raw
+}
+
+// splitNamespace splits a "database.collection" namespace into its two parts, the shape
+// mongo.ClientWriteModels' Append* methods require. Only the first "." is significant, since collection names may
+// themselves contain dots but database names may not.
+func splitNamespace(namespace string) (database, collection string, err error) {
+	parts := strings.SplitN(namespace, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid namespace %q: expected \"database.collection\"", namespace)
+	}
+	return parts[0], parts[1], nil
+}
+
+// NamespaceResult holds the portion of a client-level bulk write outcome
+// that applies to a single namespace.
+type NamespaceResult struct {
+	Successes int64
+	Failures  int64
+	// NotAttempted counts models that were never sent to the server because an earlier model in the same ordered
+	// batch failed first. They are neither successes nor failures and must be resubmitted.
+	NotAttempted int64
+	Errors       []error
+}
+
+// merge folds another NamespaceResult's counts into r.
+func (r *NamespaceResult) merge(other *NamespaceResult) {
+	r.Successes += other.Successes
+	r.Failures += other.Failures
+	r.NotAttempted += other.NotAttempted
+	r.Errors = append(r.Errors, other.Errors...)
+}
+
+// ClientBulkWriter batches documents destined for many different
+// collections and flushes them through a single mongo.Client.BulkWrite
+// call, rather than one InsertMany/BulkWrite per collection. This cuts
+// round-trips dramatically when the number of namespaces is large relative
+// to the number of documents in each.
+//
+// Like BufferedBulkWriter, it batches on both a document count limit and
+// an accumulated BSON byte-size limit, and must be flushed at the end to
+// ensure all buffered models are written. Every flush — whether triggered
+// by docLimit, the byte-size limit, or an explicit Flush call — folds its
+// outcome into a running per-namespace tally available from Results, so a
+// caller doesn't have to separately capture and demux the result of every
+// flush itself.
+type ClientBulkWriter struct {
+	client        *mongo.Client
+	models        []clientModel
+	docLimit      int
+	docCount      int
+	byteCount     int
+	ordered       bool
+	bulkWriteOpts *options.ClientBulkWriteOptions
+
+	mu      sync.Mutex
+	results map[string]*NamespaceResult
+}
+
+func newClientBulkWriter(client *mongo.Client, docLimit int, ordered bool) *ClientBulkWriter {
+	return &ClientBulkWriter{
+		client:        client,
+		bulkWriteOpts: options.ClientBulkWrite().SetOrdered(ordered),
+		docLimit:      docLimit,
+		ordered:       ordered,
+		models:        make([]clientModel, 0, docLimit),
+		results:       map[string]*NamespaceResult{},
+	}
+}
+
+// NewOrderedClientBulkWriter returns an initialized ClientBulkWriter for performing ordered, cross-collection bulk writes.
+func NewOrderedClientBulkWriter(client *mongo.Client, docLimit int) *ClientBulkWriter {
+	return newClientBulkWriter(client, docLimit, true)
+}
+
+// NewUnorderedClientBulkWriter returns an initialized ClientBulkWriter for performing unordered, cross-collection bulk writes.
+func NewUnorderedClientBulkWriter(client *mongo.Client, docLimit int) *ClientBulkWriter {
+	return newClientBulkWriter(client, docLimit, false)
+}
+
+func (cb *ClientBulkWriter) SetBypassDocumentValidation(bypass bool) *ClientBulkWriter {
+	cb.bulkWriteOpts.SetBypassDocumentValidation(bypass)
+	return cb
+}
+
+// resetBulk starts a fresh batch.
+func (cb *ClientBulkWriter) resetBulk() {
+	cb.models = make([]clientModel, 0, cap(cb.models))
+	cb.docCount = 0
+	cb.byteCount = 0
+}
+
+// InsertRaw queues a raw BSON document for insertion into namespace ("database.collection"). If the buffer becomes
+// full, the bulk write is performed, returning any error that occurs.
+func (cb *ClientBulkWriter) InsertRaw(namespace string, rawBytes bson.Raw) (*mongo.ClientBulkWriteResult, error) {
+	database, collection, err := splitNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return cb.addModel(clientModel{namespace: namespace, database: database, collection: collection, doc: rawBytes}, len(rawBytes))
+}
+
+// addModel queues model. If queuing it would push the batch past maxMessageSizeBytes, the current batch is flushed
+// first — and that pre-flush's outcome is folded into the running per-namespace tally just like any other flush,
+// so it isn't lost even though addModel itself only returns the result of a flush it triggers directly. If, after
+// adding it, docLimit documents are now queued or the batch has reached maxMessageSizeBytes, the bulk write is
+// performed, returning any error that occurs.
+func (cb *ClientBulkWriter) addModel(model clientModel, size int) (*mongo.ClientBulkWriteResult, error) {
+	if cb.docCount > 0 && cb.byteCount+size > maxMessageSizeBytes {
+		if _, err := cb.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	cb.docCount++
+	cb.byteCount += size
+	cb.models = append(cb.models, model)
+
+	if cb.docCount >= cb.docLimit || cb.byteCount >= maxMessageSizeBytes {
+		return cb.Flush()
+	}
+
+	return nil, nil
+}
+
+// Flush issues a single client-level bulk write covering every namespace buffered so far, folds its outcome into
+// the running per-namespace tally returned by Results, and resets the buffer.
+func (cb *ClientBulkWriter) Flush() (*mongo.ClientBulkWriteResult, error) {
+	if cb.docCount == 0 {
+		return nil, nil
+	}
+
+	batch := cb.models
+	defer cb.resetBulk()
+
+	var models mongo.ClientWriteModels
+	for _, m := range batch {
+		models.AppendInsertOne(m.database, m.collection, mongo.NewClientInsertOneModel().SetDocument(m.doc))
+	}
+
+	result, err := cb.client.BulkWrite(context.Background(), models, cb.bulkWriteOpts)
+	cb.observe(batch, result, err)
+	return result, err
+}
+
+// observe demultiplexes the outcome of one flushed batch back into per-namespace success/failure counts, using the
+// namespace each buffered model was queued against, and merges them into cb.results.
+//
+// A nil err means every model in the batch succeeded. A mongo.ClientBulkWriteException means only some did: models
+// named in its WriteErrors failed, and — because this writer is also used in ordered mode — any model at or past
+// the first failed index that isn't itself named as a failure was never attempted by the server and is counted as
+// NotAttempted rather than a success. Any other non-nil error means the command as a whole was rejected (network,
+// timeout, auth) and nothing in the batch is known to have been written, so every model counts as a failure.
+func (cb *ClientBulkWriter) observe(batch []clientModel, result *mongo.ClientBulkWriteResult, err error) {
+	perNS := map[string]*NamespaceResult{}
+	get := func(namespace string) *NamespaceResult {
+		if r, ok := perNS[namespace]; ok {
+			return r
+		}
+		r := &NamespaceResult{}
+		perNS[namespace] = r
+		return r
+	}
+
+	switch bwErr, partial := err.(mongo.ClientBulkWriteException); {
+	case err == nil:
+		for _, m := range batch {
+			get(m.namespace).Successes++
+		}
+
+	case !partial:
+		for _, m := range batch {
+			r := get(m.namespace)
+			r.Failures++
+			r.Errors = append(r.Errors, err)
+		}
+
+	default:
+		// ClientBulkWriteException.WriteErrors is keyed by the operation's index in the batch, not a slice with an
+		// index field, so the index has to come from the map key.
+		writeErrsByIndex := map[int]error{}
+		minFailedIndex := -1
+		for idx, we := range bwErr.WriteErrors {
+			writeErrsByIndex[idx] = fmt.Errorf("%s", we.Error())
+			if minFailedIndex == -1 || idx < minFailedIndex {
+				minFailedIndex = idx
+			}
+		}
+
+		for i, m := range batch {
+			r := get(m.namespace)
+			if writeErr, failed := writeErrsByIndex[i]; failed {
+				r.Failures++
+				r.Errors = append(r.Errors, writeErr)
+				continue
+			}
+			if cb.ordered && minFailedIndex >= 0 && i > minFailedIndex {
+				r.NotAttempted++
+				continue
+			}
+			r.Successes++
+		}
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for namespace, nsResult := range perNS {
+		total, ok := cb.results[namespace]
+		if !ok {
+			total = &NamespaceResult{}
+			cb.results[namespace] = total
+		}
+		total.merge(nsResult)
+	}
+}
+
+// Results returns the per-namespace success/failure counts accumulated across every flush so far, including any
+// triggered internally by addModel rather than by an explicit call to Flush.
+func (cb *ClientBulkWriter) Results() map[string]*NamespaceResult {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	out := make(map[string]*NamespaceResult, len(cb.results))
+	for namespace, result := range cb.results {
+		copied := *result
+		out[namespace] = &copied
+	}
+	return out
+}
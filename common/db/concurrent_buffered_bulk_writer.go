@@ -0,0 +1,361 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fastFlushThreshold is how quickly a batch has to be acknowledged for it to count toward growing the adaptive doc
+// limit. Flushes slower than this are assumed to already be network- or server-bound, so growing the batch further
+// wouldn't help throughput.
+const fastFlushThreshold = 250 * time.Millisecond
+
+// consecutiveFastFlushesToGrow is how many fast flushes in a row are required before ConcurrentBufferedBulkWriter
+// grows its adaptive doc limit.
+const consecutiveFastFlushesToGrow = 5
+
+// docLimitCeiling bounds the adaptive doc limit when avgDocSize hasn't been observed yet.
+const docLimitCeiling = 100000
+
+// ConcurrentBufferedBulkWriter is a BufferedBulkWriter variant that overlaps batch execution with batch assembly: a
+// fixed pool of worker goroutines drains sealed batches off a bounded queue and executes them concurrently, so
+// Insert/Update/Replace/Delete can keep filling the next batch instead of blocking on an in-flight BulkWrite's
+// round-trip. The queue's capacity (inflightBatches) provides backpressure — once that many sealed batches are
+// waiting for a worker to pick them up, submitting another blocks until a worker takes one off the queue. Batches a
+// worker is already executing don't count against inflightBatches.
+//
+// It also tracks an adaptive doc limit: the limit is halved whenever a batch is rejected for being too large, and
+// grown back up, toward roughly maxMessageSizeBytes/avgDocSize, after a run of quickly-acknowledged batches. This keeps
+// batches near the largest size the server will accept without callers having to guess avgDocSize themselves.
+//
+// Because batches are handed to independent workers, ordered bulk write semantics cannot be honored: batch 2 can be
+// acknowledged before batch 1. ConcurrentBufferedBulkWriter is therefore always unordered; use BufferedBulkWriter
+// instead if write order matters.
+type ConcurrentBufferedBulkWriter struct {
+	collection    *mongo.Collection
+	bulkWriteOpts *options.BulkWriteOptions
+
+	batches chan []mongo.WriteModel
+	pending sync.WaitGroup // batches submitted but not yet executed
+	workers sync.WaitGroup // live worker goroutines
+
+	errMu sync.Mutex
+	errs  []error
+
+	current      []mongo.WriteModel
+	currentBytes int
+
+	docLimit      int64 // current adaptive doc limit, accessed atomically
+	avgDocSize    int64 // EWMA of doc size in bytes, accessed atomically
+	consecutiveOK int32 // consecutive fast flushes, accessed atomically
+}
+
+// NewConcurrentBufferedBulkWriter returns a ConcurrentBufferedBulkWriter that flushes batches of up to docLimit
+// documents using workers concurrent goroutines, allowing up to inflightBatches sealed batches to be queued waiting
+// for a worker, in addition to the up to workers batches being executed.
+func NewConcurrentBufferedBulkWriter(collection *mongo.Collection, docLimit, workers, inflightBatches int) *ConcurrentBufferedBulkWriter {
+	cb := &ConcurrentBufferedBulkWriter{
+		collection:    collection,
+		bulkWriteOpts: options.BulkWrite().SetOrdered(false),
+		batches:       make(chan []mongo.WriteModel, inflightBatches),
+		current:       make([]mongo.WriteModel, 0, docLimit),
+		docLimit:      int64(docLimit),
+	}
+
+	for i := 0; i < workers; i++ {
+		cb.workers.Add(1)
+		go cb.work()
+	}
+
+	return cb
+}
+
+func (cb *ConcurrentBufferedBulkWriter) SetBypassDocumentValidation(bypass bool) *ConcurrentBufferedBulkWriter {
+	cb.bulkWriteOpts.SetBypassDocumentValidation(bypass)
+	return cb
+}
+
+// work is a worker goroutine's main loop: it pulls sealed batches off cb.batches and executes them, in its own
+// slice, until the queue is closed by Close.
+func (cb *ConcurrentBufferedBulkWriter) work() {
+	defer cb.workers.Done()
+
+	for models := range cb.batches {
+		cb.execute(models)
+	}
+}
+
+// execute runs one batch and accounts for its outcome. A batch rejected for being too large is never dropped: it's
+// split in two and each half is resubmitted to cb.batches (by a separate goroutine, so a worker blocked on a full
+// queue can't deadlock against itself) to be retried as is; the halved adaptive docLimit that adapt just set applies
+// to batches sealed from then on.
+// A single-model batch that's still too large can't be split further, so its error is recorded like any other.
+func (cb *ConcurrentBufferedBulkWriter) execute(models []mongo.WriteModel) {
+	start := time.Now()
+	_, err := cb.collection.BulkWrite(context.Background(), models, cb.bulkWriteOpts)
+	cb.adapt(time.Since(start), err)
+
+	if err != nil && isMessageTooLargeError(err) && len(models) > 1 {
+		mid := len(models) / 2
+		left, right := models[:mid], models[mid:]
+		cb.pending.Add(2)
+		go func() { cb.batches <- left }()
+		go func() { cb.batches <- right }()
+		cb.pending.Done()
+		return
+	}
+
+	if err != nil {
+		cb.errMu.Lock()
+		cb.errs = append(cb.errs, err)
+		cb.errMu.Unlock()
+	}
+
+	cb.pending.Done()
+}
+
+// adapt updates the adaptive doc limit based on the outcome of one flushed batch.
+func (cb *ConcurrentBufferedBulkWriter) adapt(elapsed time.Duration, err error) {
+	if err != nil && isMessageTooLargeError(err) {
+		atomic.StoreInt32(&cb.consecutiveOK, 0)
+		for {
+			old := atomic.LoadInt64(&cb.docLimit)
+			next := old / 2
+			if next < 1 {
+				next = 1
+			}
+			if atomic.CompareAndSwapInt64(&cb.docLimit, old, next) {
+				break
+			}
+		}
+		return
+	}
+
+	if elapsed > fastFlushThreshold {
+		atomic.StoreInt32(&cb.consecutiveOK, 0)
+		return
+	}
+
+	if atomic.AddInt32(&cb.consecutiveOK, 1) < consecutiveFastFlushesToGrow {
+		return
+	}
+	atomic.StoreInt32(&cb.consecutiveOK, 0)
+
+	ceiling := int64(docLimitCeiling)
+	if avgDocSize := atomic.LoadInt64(&cb.avgDocSize); avgDocSize > 0 {
+		ceiling = maxMessageSizeBytes / avgDocSize
+	}
+
+	for {
+		old := atomic.LoadInt64(&cb.docLimit)
+		next := old + old/2
+		if next == old {
+			next = old + 1
+		}
+		if next > ceiling {
+			next = ceiling
+		}
+		if next <= old || atomic.CompareAndSwapInt64(&cb.docLimit, old, next) {
+			break
+		}
+	}
+}
+
+// isMessageTooLargeError reports whether err is caused by the batch exceeding the server's maximum message size, as
+// opposed to a data or constraint error unrelated to batch size. The driver rejects an oversized batch before it's
+// even sent, as a plain top-level error, not a per-document write error inside a BulkWriteException — so this checks
+// err's own message first and only falls back to scanning WriteErrors for a server-side "too large" response.
+func isMessageTooLargeError(err error) bool {
+	if messageTooLarge(err.Error()) {
+		return true
+	}
+
+	bwErr, ok := err.(mongo.BulkWriteException)
+	if !ok {
+		return false
+	}
+	for _, writeErr := range bwErr.WriteErrors {
+		if messageTooLarge(writeErr.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTooLarge reports whether an error message describes a document or batch exceeding the server's maximum
+// message/document size, under any of the phrasings the driver and server are known to use.
+func messageTooLarge(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, phrase := range []string{"too large", "message size", "message length", "object to insert too large", "exceeds maximum"} {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAvgDocSize folds size into the EWMA (alpha = 0.2) of document size used to pick the adaptive doc limit's
+// growth ceiling.
+func (cb *ConcurrentBufferedBulkWriter) updateAvgDocSize(size int) {
+	for {
+		old := atomic.LoadInt64(&cb.avgDocSize)
+		next := int64(size)
+		if old != 0 {
+			next = old + (int64(size)-old)/5
+		}
+		if atomic.CompareAndSwapInt64(&cb.avgDocSize, old, next) {
+			return
+		}
+	}
+}
+
+// addModel adds a WriteModel of approximately size bytes to the current batch, sealing and submitting it for
+// asynchronous execution once the adaptive doc limit is reached. Submitting a sealed batch blocks if
+// inflightBatches batches are already queued waiting for a worker, providing backpressure on the caller.
+func (cb *ConcurrentBufferedBulkWriter) addModel(model mongo.WriteModel, size int) {
+	cb.updateAvgDocSize(size)
+
+	cb.current = append(cb.current, model)
+	cb.currentBytes += size
+
+	limit := atomic.LoadInt64(&cb.docLimit)
+	if int64(len(cb.current)) >= limit || cb.currentBytes >= maxMessageSizeBytes {
+		cb.seal()
+	}
+}
+
+// seal submits the current batch for asynchronous execution and starts a fresh one.
+func (cb *ConcurrentBufferedBulkWriter) seal() {
+	if len(cb.current) == 0 {
+		return
+	}
+	cb.pending.Add(1)
+	cb.batches <- cb.current
+	cb.current = make([]mongo.WriteModel, 0, cap(cb.current))
+	cb.currentBytes = 0
+}
+
+// Insert adds a document for bulk insertion. See BufferedBulkWriter.Insert.
+func (cb *ConcurrentBufferedBulkWriter) Insert(doc interface{}) error {
+	rawBytes, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("bson encoding error: %v", err)
+	}
+	return cb.InsertRaw(rawBytes)
+}
+
+// InsertRaw adds a raw bson document for bulk insertion. See BufferedBulkWriter.InsertRaw.
+func (cb *ConcurrentBufferedBulkWriter) InsertRaw(rawBytes bson.Raw) error {
+	cb.addModel(mongo.NewInsertOneModel().SetDocument(rawBytes), len(rawBytes))
+	return cb.nextError()
+}
+
+// Update adds an update-one (or update-many, if multi is set) write model. See BufferedBulkWriter.Update.
+func (cb *ConcurrentBufferedBulkWriter) Update(filter, update interface{}, upsert, multi bool) error {
+	size, err := modelSize(filter, update)
+	if err != nil {
+		return err
+	}
+
+	if multi {
+		cb.addModel(mongo.NewUpdateManyModel().SetFilter(filter).SetUpdate(update).SetUpsert(upsert), size)
+	} else {
+		cb.addModel(mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(upsert), size)
+	}
+	return cb.nextError()
+}
+
+// Replace adds a replace-one write model. See BufferedBulkWriter.Replace.
+func (cb *ConcurrentBufferedBulkWriter) Replace(filter, replacement interface{}, upsert bool) error {
+	size, err := modelSize(filter, replacement)
+	if err != nil {
+		return err
+	}
+	cb.addModel(mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(replacement).SetUpsert(upsert), size)
+	return cb.nextError()
+}
+
+// Delete adds a delete-one (or delete-many, if multi is set) write model. See BufferedBulkWriter.Delete.
+func (cb *ConcurrentBufferedBulkWriter) Delete(filter interface{}, multi bool) error {
+	size, err := modelSize(filter)
+	if err != nil {
+		return err
+	}
+
+	if multi {
+		cb.addModel(mongo.NewDeleteManyModel().SetFilter(filter), size)
+	} else {
+		cb.addModel(mongo.NewDeleteOneModel().SetFilter(filter), size)
+	}
+	return cb.nextError()
+}
+
+// nextError pops and returns the oldest error a worker has recorded but no caller has seen yet, or nil if there are
+// none. Each error is surfaced to exactly one caller — either the next Insert/Update/Replace/Delete after it's
+// recorded, or Flush if nothing asked first — rather than every call repeating the same stale error until Flush.
+func (cb *ConcurrentBufferedBulkWriter) nextError() error {
+	cb.errMu.Lock()
+	defer cb.errMu.Unlock()
+	if len(cb.errs) == 0 {
+		return nil
+	}
+	err := cb.errs[0]
+	cb.errs = cb.errs[1:]
+	return err
+}
+
+// multiBatchError reports every batch-level error accumulated across one or more concurrently executed batches.
+// Unlike BufferedBulkWriter's single BulkWriteException, each entry here is the failure of an entire batch rather
+// than one document within a batch, so none can be dropped without understating how many batches actually failed.
+type multiBatchError []error
+
+func (e multiBatchError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d batch(es) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Flush seals the current (possibly partial) batch, waits for it and every previously-submitted batch to finish
+// executing, and returns every not-yet-seen error encountered across all of them, joined into a multiBatchError, if
+// any. A single error is returned unwrapped.
+func (cb *ConcurrentBufferedBulkWriter) Flush() error {
+	cb.seal()
+	cb.pending.Wait()
+
+	cb.errMu.Lock()
+	errs := cb.errs
+	cb.errs = nil
+	cb.errMu.Unlock()
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return multiBatchError(errs)
+	}
+}
+
+// Close stops all worker goroutines. Flush should be called first to ensure every buffered document has been
+// written.
+func (cb *ConcurrentBufferedBulkWriter) Close() {
+	close(cb.batches)
+	cb.workers.Wait()
+}
@@ -0,0 +1,54 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mongodb/mongo-tools/common/db"
+)
+
+// ClientBulkRestoreWorker funnels documents for every namespace in a dump through a single db.ClientBulkWriter,
+// instead of a per-collection BufferedBulkWriter. It's the engine behind mongorestore's opt-in client-level bulk
+// write mode, for dumps with many small namespaces where per-collection round-trips dominate.
+type ClientBulkRestoreWorker struct {
+	writer *db.ClientBulkWriter
+}
+
+// NewClientBulkRestoreWorker returns a ClientBulkRestoreWorker that batches writes across namespaces using client,
+// up to docLimit documents (or the accumulated BSON byte limit) per flush.
+func NewClientBulkRestoreWorker(client *mongo.Client, docLimit int, ordered bool) *ClientBulkRestoreWorker {
+	var writer *db.ClientBulkWriter
+	if ordered {
+		writer = db.NewOrderedClientBulkWriter(client, docLimit)
+	} else {
+		writer = db.NewUnorderedClientBulkWriter(client, docLimit)
+	}
+
+	return &ClientBulkRestoreWorker{writer: writer}
+}
+
+// Insert queues rawBytes for insertion into namespace, flushing if the batch is now full. db.ClientBulkWriter folds
+// the outcome of every flush, including this one, into the per-namespace results returned by Results.
+func (w *ClientBulkRestoreWorker) Insert(namespace string, rawBytes bson.Raw) error {
+	_, err := w.writer.InsertRaw(namespace, rawBytes)
+	return err
+}
+
+// Flush flushes any partial batch.
+func (w *ClientBulkRestoreWorker) Flush() error {
+	_, err := w.writer.Flush()
+	return err
+}
+
+// Results returns the accumulated per-namespace success/failure counts across every Insert/Flush so far. Callers
+// fold these into restore.Result.Successes/Failures instead of the single aggregate count a per-collection
+// BufferedBulkWriter would have produced.
+func (w *ClientBulkRestoreWorker) Results() map[string]*db.NamespaceResult {
+	return w.writer.Results()
+}
@@ -0,0 +1,106 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongorestore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mongodb/mongo-tools/common/db"
+)
+
+// JournalWriter is an append-only, fsync'd record of the last successfully flushed batch's offset in each
+// namespace's source BSON file. Pairing it with db.BufferedBulkWriter.SetPostFlushHook lets mongorestore resume an
+// interrupted restore by seeking each input file to its recorded offset instead of starting over.
+//
+// Each write is one line of the form "<namespace>\t<offset>\n"; on restart, the last line recorded for a given
+// namespace is its resume point.
+type JournalWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJournalWriter opens (creating if necessary) the journal file at path for appending and returns a JournalWriter
+// backed by it.
+func NewJournalWriter(path string) (*JournalWriter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal %q: %v", path, err)
+	}
+	return &JournalWriter{file: file}, nil
+}
+
+// HookForNamespace returns a db.PostFlushHook that appends and fsyncs one line recording watermark as the resume
+// offset for namespace. It's meant to be passed to db.BufferedBulkWriter.SetPostFlushHook for the writer handling
+// that namespace.
+func (j *JournalWriter) HookForNamespace(namespace string) db.PostFlushHook {
+	return func(watermark int64) error {
+		return j.record(namespace, watermark)
+	}
+}
+
+func (j *JournalWriter) record(namespace string, watermark int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := fmt.Fprintf(j.file, "%s\t%d\n", namespace, watermark); err != nil {
+		return fmt.Errorf("writing journal entry for %s: %v", namespace, err)
+	}
+	return j.file.Sync()
+}
+
+// Close closes the underlying journal file.
+func (j *JournalWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// LoadJournalOffsets reads the journal file at path and returns, for each namespace it mentions, the offset from
+// its last recorded line (later entries in the file override earlier ones). It's used on restart to decide where
+// each input file should be seeked to before resuming a restore. A journal that doesn't exist yet yields an empty
+// map, since that just means no progress has been recorded.
+func LoadJournalOffsets(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening journal %q: %v", path, err)
+	}
+	defer file.Close()
+
+	offsets := map[string]int64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed journal line %q", line)
+		}
+
+		watermark, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed journal line %q: %v", line, err)
+		}
+
+		offsets[parts[0]] = watermark
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal %q: %v", path, err)
+	}
+
+	return offsets, nil
+}